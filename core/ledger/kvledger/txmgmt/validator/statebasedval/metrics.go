@@ -0,0 +1,158 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statebasedval
+
+import (
+	"time"
+
+	"github.com/hyperledger/fabric/common/metrics"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+var (
+	envelopeUnmarshalDurationOpts = metrics.HistogramOpts{
+		Namespace:    "statevalidator",
+		Name:         "envelope_unmarshal_seconds",
+		Help:         "Time taken to unmarshal a transaction envelope and extract its read/write set.",
+		StatsdFormat: "%{#fqname}",
+	}
+
+	validateEndorserTxDurationOpts = metrics.HistogramOpts{
+		Namespace:    "statevalidator",
+		Name:         "validate_endorser_tx_seconds",
+		Help:         "Time taken to MVCC-validate a single endorser transaction.",
+		StatsdFormat: "%{#fqname}",
+	}
+
+	addWriteSetDurationOpts = metrics.HistogramOpts{
+		Namespace:    "statevalidator",
+		Name:         "add_writeset_seconds",
+		Help:         "Time taken to apply a transaction's write-set to the block's update batch.",
+		StatsdFormat: "%{#fqname}",
+	}
+
+	bulkLoadVersionsDurationOpts = metrics.HistogramOpts{
+		Namespace:    "statevalidator",
+		Name:         "bulk_load_versions_seconds",
+		Help:         "Time taken to bulk-load committed key versions ahead of validating a block.",
+		StatsdFormat: "%{#fqname}",
+	}
+
+	pluginDispatchDurationOpts = metrics.HistogramOpts{
+		Namespace:    "statevalidator",
+		Name:         "plugin_dispatch_seconds",
+		Help:         "Time taken to run the registered PluginDispatcher against a single endorser transaction.",
+		StatsdFormat: "%{#fqname}",
+	}
+
+	txValidationResultOpts = metrics.CounterOpts{
+		Namespace:    "statevalidator",
+		Name:         "tx_validation_result",
+		Help:         "Number of transactions validated, labeled by validation result code.",
+		LabelNames:   []string{"code"},
+		StatsdFormat: "%{#fqname}.%{code}",
+	}
+
+	mvccConflictsOpts = metrics.CounterOpts{
+		Namespace:    "statevalidator",
+		Name:         "mvcc_conflicts_total",
+		Help:         "Number of MVCC read and phantom-read conflicts detected, labeled by namespace.",
+		LabelNames:   []string{"ns"},
+		StatsdFormat: "%{#fqname}.%{ns}",
+	}
+)
+
+// Metrics holds the measurements exposed by the state validator. A nil
+// *Metrics is safe to use: every method on it is a no-op, so a Validator
+// constructed with a nil metrics.Provider keeps working without having to be
+// special-cased at every call site.
+type Metrics struct {
+	EnvelopeUnmarshalDuration  metrics.Histogram
+	ValidateEndorserTxDuration metrics.Histogram
+	AddWriteSetDuration        metrics.Histogram
+	BulkLoadVersionsDuration   metrics.Histogram
+	PluginDispatchDuration     metrics.Histogram
+	TxValidationResult         metrics.Counter
+	MVCCConflicts              metrics.Counter
+}
+
+// NewMetrics constructs the state validator's metrics from the given
+// provider. provider may be nil, in which case the returned *Metrics
+// discards every measurement.
+func NewMetrics(provider metrics.Provider) *Metrics {
+	if provider == nil {
+		return nil
+	}
+	return &Metrics{
+		EnvelopeUnmarshalDuration:  provider.NewHistogram(envelopeUnmarshalDurationOpts),
+		ValidateEndorserTxDuration: provider.NewHistogram(validateEndorserTxDurationOpts),
+		AddWriteSetDuration:        provider.NewHistogram(addWriteSetDurationOpts),
+		BulkLoadVersionsDuration:   provider.NewHistogram(bulkLoadVersionsDurationOpts),
+		PluginDispatchDuration:     provider.NewHistogram(pluginDispatchDurationOpts),
+		TxValidationResult:         provider.NewCounter(txValidationResultOpts),
+		MVCCConflicts:              provider.NewCounter(mvccConflictsOpts),
+	}
+}
+
+func (m *Metrics) observeEnvelopeUnmarshal(since time.Time) {
+	if m == nil {
+		return
+	}
+	m.EnvelopeUnmarshalDuration.Observe(time.Since(since).Seconds())
+}
+
+func (m *Metrics) observeValidateEndorserTx(since time.Time) {
+	if m == nil {
+		return
+	}
+	m.ValidateEndorserTxDuration.Observe(time.Since(since).Seconds())
+}
+
+func (m *Metrics) observeAddWriteSet(since time.Time) {
+	if m == nil {
+		return
+	}
+	m.AddWriteSetDuration.Observe(time.Since(since).Seconds())
+}
+
+func (m *Metrics) observeBulkLoadVersions(since time.Time) {
+	if m == nil {
+		return
+	}
+	m.BulkLoadVersionsDuration.Observe(time.Since(since).Seconds())
+}
+
+func (m *Metrics) observePluginDispatch(since time.Time) {
+	if m == nil {
+		return
+	}
+	m.PluginDispatchDuration.Observe(time.Since(since).Seconds())
+}
+
+func (m *Metrics) recordValidationResult(code peer.TxValidationCode) {
+	if m == nil {
+		return
+	}
+	m.TxValidationResult.With("code", code.String()).Add(1)
+}
+
+func (m *Metrics) recordMVCCConflict(ns string) {
+	if m == nil {
+		return
+	}
+	m.MVCCConflicts.With("ns", ns).Add(1)
+}
@@ -0,0 +1,488 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statebasedval
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/privacyenabledstate"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/hyperledger/fabric/core/ledger/util"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/peer"
+	putils "github.com/hyperledger/fabric/protos/utils"
+)
+
+// ValidatorConfig exposes the tunables of the concurrent validation pipeline.
+type ValidatorConfig struct {
+	// MaxConcurrency bounds the number of transactions validated in parallel
+	// for a single block. A value <= 0 falls back to runtime.NumCPU().
+	MaxConcurrency int
+}
+
+func (c *ValidatorConfig) maxConcurrency() int {
+	if c == nil || c.MaxConcurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return c.MaxConcurrency
+}
+
+// touchedKey identifies a single read or write performed by a transaction,
+// in the composite-key space of the underlying store (hashed private-data
+// keys are addressed by their derived namespace, same as everywhere else in
+// this package).
+type touchedKey struct {
+	ns  string
+	key string
+}
+
+// parsedTx holds the result of parsing and extracting the rwset for a single
+// transaction within a block, ahead of MVCC validation.
+type parsedTx struct {
+	txIndex int
+	chdr    *common.ChannelHeader
+	txType  common.HeaderType
+	// skip is true for transaction types that are not subject to MVCC
+	// validation and for which no PostOrderValidator is registered; such
+	// transactions are left untouched in the validation flags, matching the
+	// legacy behavior.
+	skip bool
+	// postOrder is true for a non-endorser transaction type that has a
+	// PostOrderValidator registered; envBytes is retained so the validation
+	// stage can hand it to that validator for simulation.
+	postOrder bool
+	envBytes  []byte
+	txRWSet   *rwsetutil.TxRwSet
+	// resultCode is pre-populated when the envelope's rwset could not be
+	// extracted, so that the validation stage can skip straight to setting
+	// the validation flag without attempting MVCC validation.
+	resultCode peer.TxValidationCode
+}
+
+// parseBlockForValidation extracts the envelope, channel header and rwset for
+// every non-invalidated transaction of the block concurrently, bounded by
+// maxConcurrency. The returned slice is indexed by original tx index; an
+// entry is nil for a transaction already marked invalid by the committer.
+func (v *Validator) parseBlockForValidation(block *common.Block, txsFilter util.TxValidationFlags, maxConcurrency int) ([]*parsedTx, error) {
+	parsedTxs := make([]*parsedTx, len(block.Data.Data))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	for txIndex, envBytes := range block.Data.Data {
+		if txsFilter.IsInvalid(txIndex) {
+			logger.Warningf("Block [%d] Transaction index [%d] marked as invalid by committer. Reason code [%d]",
+				block.Header.Number, txIndex, txsFilter.Flag(txIndex))
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(txIndex int, envBytes []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			parsed, err := v.parseTx(block, txIndex, envBytes)
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+			parsedTxs[txIndex] = parsed
+		}(txIndex, envBytes)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return parsedTxs, nil
+}
+
+func (v *Validator) parseTx(block *common.Block, txIndex int, envBytes []byte) (*parsedTx, error) {
+	defer v.metrics.observeEnvelopeUnmarshal(time.Now())
+
+	env, err := putils.GetEnvelopeFromBlock(envBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := putils.GetPayload(env)
+	if err != nil {
+		return nil, err
+	}
+
+	chdr, err := putils.UnmarshalChannelHeader(payload.Header.ChannelHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	txType := common.HeaderType(chdr.Type)
+	parsed := &parsedTx{txIndex: txIndex, chdr: chdr, txType: txType}
+
+	if txType != common.HeaderType_ENDORSER_TRANSACTION {
+		if _, ok := v.postOrderValidators[txType]; ok {
+			logger.Debugf("Block [%d] Transaction index [%d] of type [%s] will be handled by the registered post-order validator",
+				block.Header.Number, txIndex, txType)
+			parsed.postOrder = true
+			parsed.envBytes = envBytes
+			return parsed, nil
+		}
+		logger.Debugf("Skipping mvcc validation for Block [%d] Transaction index [%d] because, the transaction type is [%s]",
+			block.Header.Number, txIndex, txType)
+		parsed.skip = true
+		return parsed, nil
+	}
+
+	if v.pluginDispatcher != nil {
+		dispatchPayload, err := chaincodeActionPayloadBytes(payload.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		dispatchStart := time.Now()
+		dispatchResult, err := v.pluginDispatcher.Dispatch(txIndex, dispatchPayload, envBytes, block)
+		v.metrics.observePluginDispatch(dispatchStart)
+		if err != nil {
+			return nil, err
+		}
+		if dispatchResult != peer.TxValidationCode_VALID {
+			logger.Warningf("Block [%d] Transaction index [%d] failed endorsement-policy validation with code [%d]",
+				block.Header.Number, txIndex, dispatchResult)
+			parsed.resultCode = dispatchResult
+			return parsed, nil
+		}
+	}
+
+	respPayload, err := putils.GetActionFromEnvelope(envBytes)
+	if err != nil {
+		parsed.resultCode = peer.TxValidationCode_NIL_TXACTION
+		return parsed, nil
+	}
+
+	txRWSet := &rwsetutil.TxRwSet{}
+	if err := txRWSet.FromProtoBytes(respPayload.Results); err != nil {
+		parsed.resultCode = peer.TxValidationCode_INVALID_OTHER_REASON
+		return parsed, nil
+	}
+
+	parsed.txRWSet = txRWSet
+	return parsed, nil
+}
+
+// chaincodeActionPayloadBytes extracts the marshaled ChaincodeActionPayload
+// that a PluginDispatcher expects out of txData, the Data field of an
+// endorser transaction's common.Payload. txData unmarshals to a
+// peer.Transaction wrapping one or more peer.TransactionAction entries, each
+// carrying its own marshaled ChaincodeActionPayload in Payload - it is not
+// itself a ChaincodeActionPayload, so it cannot be forwarded to Dispatch
+// as-is. Only the first action is dispatched, matching the single-action
+// case that parseTx's later GetActionFromEnvelope call already assumes.
+func chaincodeActionPayloadBytes(txData []byte) ([]byte, error) {
+	tx, err := putils.GetTransaction(txData)
+	if err != nil {
+		return nil, err
+	}
+	if len(tx.Actions) == 0 || tx.Actions[0] == nil {
+		return nil, errors.New("envelope carries no transaction actions to dispatch")
+	}
+	return tx.Actions[0].Payload, nil
+}
+
+// buildKeyDependencyGraph computes, for every transaction in the block, the
+// set of preceding transactions it must wait on before it can start
+// validating. For an endorser transaction this is every preceding
+// transaction that wrote a key it reads or writes (RAW/WAW), and every
+// preceding transaction that read a key it writes (WAR): a later write must
+// never be visible to an earlier transaction's read-set validation, exactly
+// as the sequential loop achieved by construction. Since two readers of the
+// same key never depend on each other, there can be several such readers
+// outstanding since the key's last writer, not just the immediately
+// preceding one - so a writer must depend on every reader since that last
+// writer, not only the most recent, or an earlier reader could still be
+// racing to validate (or not even have started) by the time the writer's
+// done channel lets everything depending on it proceed. A post-order
+// transaction's read/write set is not known until it is actually simulated,
+// so it is treated as a full barrier: it waits on every transaction that
+// precedes it, not just the immediately preceding one, since two unrelated
+// earlier transactions may otherwise still be racing each other with no
+// dependency edge between them; every transaction after it waits on it in
+// turn. A transaction absent from the returned map can validate as soon as
+// it is parsed.
+func buildKeyDependencyGraph(parsedTxs []*parsedTx) map[int][]int {
+	lastWriter := make(map[touchedKey]int)
+	readersSinceLastWriter := make(map[touchedKey][]int)
+	dependsOn := make(map[int][]int)
+	lastBarrier := -1
+	var priorIndices []int
+
+	addDependency := func(txIndex, onIndex int) {
+		if onIndex < 0 {
+			return
+		}
+		dependsOn[txIndex] = append(dependsOn[txIndex], onIndex)
+	}
+
+	for _, parsed := range parsedTxs {
+		if parsed == nil {
+			continue
+		}
+
+		if parsed.postOrder {
+			for _, priorIdx := range priorIndices {
+				addDependency(parsed.txIndex, priorIdx)
+			}
+			lastBarrier = parsed.txIndex
+			priorIndices = append(priorIndices, parsed.txIndex)
+			continue
+		}
+
+		addDependency(parsed.txIndex, lastBarrier)
+
+		if parsed.txRWSet != nil {
+			readKeys := readKeysOf(parsed.txRWSet)
+			for _, key := range readKeys {
+				if writerIdx, ok := lastWriter[key]; ok {
+					addDependency(parsed.txIndex, writerIdx)
+				}
+			}
+			for _, key := range writeKeysOf(parsed.txRWSet) {
+				if writerIdx, ok := lastWriter[key]; ok {
+					addDependency(parsed.txIndex, writerIdx)
+				}
+				for _, readerIdx := range readersSinceLastWriter[key] {
+					addDependency(parsed.txIndex, readerIdx)
+				}
+				delete(readersSinceLastWriter, key)
+				lastWriter[key] = parsed.txIndex
+			}
+			for _, key := range readKeys {
+				readersSinceLastWriter[key] = append(readersSinceLastWriter[key], parsed.txIndex)
+			}
+		}
+		priorIndices = append(priorIndices, parsed.txIndex)
+	}
+	return dependsOn
+}
+
+func readKeysOf(txRWSet *rwsetutil.TxRwSet) []touchedKey {
+	var keys []touchedKey
+	for _, nsRWSet := range txRWSet.NsRwSets {
+		for _, kvRead := range nsRWSet.KvRwSet.Reads {
+			keys = append(keys, touchedKey{nsRWSet.NameSpace, kvRead.Key})
+		}
+		for _, collHashedRWSet := range nsRWSet.CollHashedRwSets {
+			hashedNs := privacyenabledstate.DeriveHashedDataNs(nsRWSet.NameSpace, collHashedRWSet.CollectionName)
+			for _, kvReadHash := range collHashedRWSet.HashedRwSet.HashedReads {
+				keys = append(keys, touchedKey{hashedNs, string(kvReadHash.KeyHash)})
+			}
+		}
+	}
+	return keys
+}
+
+// conflictingNamespaces returns the distinct namespaces touched by a
+// transaction whose MVCC validation failed, for labeling the mvcc_conflicts_total
+// counter. It is a coarse attribution - the transaction may have only
+// conflicted on one of several namespaces it reads or writes - but pinpointing
+// the exact offending namespace would require validateTx to thread it back
+// through every return path, which isn't worth the complexity for a metric.
+func conflictingNamespaces(parsed *parsedTx) []string {
+	if parsed.txRWSet == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, nsRWSet := range parsed.txRWSet.NsRwSets {
+		if !seen[nsRWSet.NameSpace] {
+			seen[nsRWSet.NameSpace] = true
+			namespaces = append(namespaces, nsRWSet.NameSpace)
+		}
+	}
+	return namespaces
+}
+
+func writeKeysOf(txRWSet *rwsetutil.TxRwSet) []touchedKey {
+	var keys []touchedKey
+	for _, nsRWSet := range txRWSet.NsRwSets {
+		for _, kvWrite := range nsRWSet.KvRwSet.Writes {
+			keys = append(keys, touchedKey{nsRWSet.NameSpace, kvWrite.Key})
+		}
+		for _, collHashedRWSet := range nsRWSet.CollHashedRwSets {
+			hashedNs := privacyenabledstate.DeriveHashedDataNs(nsRWSet.NameSpace, collHashedRWSet.CollectionName)
+			for _, kvWriteHash := range collHashedRWSet.HashedRwSet.HashedWrites {
+				keys = append(keys, touchedKey{hashedNs, string(kvWriteHash.KeyHash)})
+			}
+		}
+	}
+	return keys
+}
+
+// validateAndCommitConcurrently runs MVCC validation for every parsed
+// transaction against v.db and the shared updates batch, honoring the
+// dependency graph so a transaction only starts once every transaction it
+// depends on has had its writes folded into updates. Transactions with no
+// dependency validate immediately and concurrently, bounded by
+// maxConcurrency; the resulting writes are applied to updates under a short
+// critical section so the batch always reflects a single well-defined
+// interleaving, regardless of goroutine scheduling.
+func (v *Validator) validateAndCommitConcurrently(
+	block *common.Block,
+	parsedTxs []*parsedTx,
+	doMVCCValidation bool,
+	updates *statedb.UpdateBatch,
+	txsFilter util.TxValidationFlags,
+	maxConcurrency int,
+) error {
+	dependsOn := buildKeyDependencyGraph(parsedTxs)
+
+	done := make([]chan struct{}, len(parsedTxs))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	var commitMu sync.Mutex
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	for _, parsed := range parsedTxs {
+		if parsed == nil {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(parsed *parsedTx) {
+			defer wg.Done()
+			defer close(done[parsed.txIndex])
+			defer func() { <-sem }()
+
+			for _, depIdx := range dependsOn[parsed.txIndex] {
+				<-done[depIdx]
+			}
+
+			applicable, txResult, txRWSet, err := v.validateParsedTx(parsed, doMVCCValidation, updates, &commitMu)
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+			if !applicable {
+				return
+			}
+
+			txsFilter.SetFlag(parsed.txIndex, txResult)
+			if txResult == peer.TxValidationCode_MVCC_READ_CONFLICT || txResult == peer.TxValidationCode_PHANTOM_READ_CONFLICT {
+				for _, ns := range conflictingNamespaces(parsed) {
+					v.metrics.recordMVCCConflict(ns)
+				}
+			}
+
+			if txRWSet != nil {
+				committingTxHeight := version.NewHeight(block.Header.Number, uint64(parsed.txIndex))
+				writeSetStart := time.Now()
+				commitMu.Lock()
+				addWriteSetToBatch(txRWSet, committingTxHeight, updates)
+				commitMu.Unlock()
+				v.metrics.observeAddWriteSet(writeSetStart)
+				txsFilter.SetFlag(parsed.txIndex, peer.TxValidationCode_VALID)
+			}
+			v.metrics.recordValidationResult(txsFilter.Flag(parsed.txIndex))
+
+			if txsFilter.IsValid(parsed.txIndex) {
+				logger.Debugf("Block [%d] Transaction index [%d] TxId [%s] marked as valid by state validator",
+					block.Header.Number, parsed.txIndex, parsed.chdr.TxId)
+			} else {
+				logger.Warningf("Block [%d] Transaction index [%d] TxId [%s] marked as invalid by state validator. Reason code [%d]",
+					block.Header.Number, parsed.txIndex, parsed.chdr.TxId, txsFilter.Flag(parsed.txIndex))
+			}
+		}(parsed)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// validateParsedTx runs MVCC validation for a single already-parsed
+// transaction. The returned bool reports whether the caller should set a
+// validation flag at all (false for non-endorser transaction types with no
+// registered PostOrderValidator, which the legacy sequential loop left
+// untouched). commitMu is threaded down into
+// validateTx rather than held for the whole call: it only guards the handful
+// of points that actually read or write the shared updates batch (see
+// validateKVRead, validateHashedKVRead and validateRangeQuery), so two
+// transactions with no dependency edge between them genuinely validate
+// concurrently instead of being serialized on a block-wide lock.
+func (v *Validator) validateParsedTx(parsed *parsedTx, doMVCCValidation bool, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, peer.TxValidationCode, *rwsetutil.TxRwSet, error) {
+	if parsed.postOrder {
+		return v.validatePostOrderTx(parsed, updates, commitMu)
+	}
+	if parsed.skip {
+		return false, peer.TxValidationCode_VALID, nil, nil
+	}
+	if parsed.txRWSet == nil {
+		return true, parsed.resultCode, nil, nil
+	}
+
+	txResult := peer.TxValidationCode_VALID
+	var err error
+	if doMVCCValidation {
+		validateStart := time.Now()
+		txResult, err = v.validateTx(parsed.txRWSet, updates, commitMu)
+		v.metrics.observeValidateEndorserTx(validateStart)
+		if err != nil {
+			return true, txResult, nil, err
+		}
+	}
+	if txResult != peer.TxValidationCode_VALID {
+		return true, txResult, nil, nil
+	}
+	return true, txResult, parsed.txRWSet, nil
+}
+
+// validatePostOrderTx hands a non-endorser transaction to its registered
+// PostOrderValidator, simulating it against a fresh TxSimulator backed by the
+// ledger state as it stands once every preceding transaction in the block has
+// been committed to updates. Unlike the endorser path through validateTx,
+// commitMu is never taken here, not even around the simulation itself: buildKeyDependencyGraph already treats
+// a post-order transaction as a full barrier, so by the time it starts every
+// preceding transaction's writes are already folded into updates and nothing
+// else in the block is validating concurrently with it.
+func (v *Validator) validatePostOrderTx(parsed *parsedTx, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, peer.TxValidationCode, *rwsetutil.TxRwSet, error) {
+	postOrderValidator := v.postOrderValidators[parsed.txType]
+
+	simulator, err := v.postOrderSimulatorProvider.NewTxSimulator(parsed.chdr.TxId, updates)
+	if err != nil {
+		return true, peer.TxValidationCode(-1), nil, err
+	}
+	defer simulator.Done()
+
+	txRWSet, txResult, err := postOrderValidator.Validate(parsed.txType, parsed.envBytes, simulator)
+	if err != nil {
+		return true, txResult, nil, err
+	}
+	if txResult != peer.TxValidationCode_VALID {
+		return true, txResult, nil, nil
+	}
+	return true, txResult, txRWSet, nil
+}
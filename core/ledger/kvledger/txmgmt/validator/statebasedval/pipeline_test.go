@@ -0,0 +1,359 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statebasedval
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/util"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// rwTx builds a parsedTx with an endorser rwset that reads readKeys and
+// writes writeKeys in a single namespace, for exercising buildKeyDependencyGraph.
+func rwTx(txIndex int, readKeys, writeKeys []string) *parsedTx {
+	kvRwSet := &kvrwset.KVRWSet{}
+	for _, k := range readKeys {
+		kvRwSet.Reads = append(kvRwSet.Reads, &kvrwset.KVRead{Key: k})
+	}
+	for _, k := range writeKeys {
+		kvRwSet.Writes = append(kvRwSet.Writes, &kvrwset.KVWrite{Key: k})
+	}
+	return &parsedTx{
+		txIndex: txIndex,
+		txRWSet: &rwsetutil.TxRwSet{
+			NsRwSets: []*rwsetutil.NsRwSet{{NameSpace: "ns", KvRwSet: kvRwSet}},
+		},
+	}
+}
+
+func postOrderTx(txIndex int) *parsedTx {
+	return &parsedTx{txIndex: txIndex, postOrder: true}
+}
+
+func dependsOnIndex(dependsOn map[int][]int, txIndex, onIndex int) bool {
+	for _, dep := range dependsOn[txIndex] {
+		if dep == onIndex {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuildKeyDependencyGraphWAR(t *testing.T) {
+	// tx0 reads K with no prior writer, tx1 writes K. Without a WAR edge,
+	// tx1's write could race ahead of tx0's read-set validation and be
+	// folded into updates before tx0 observes the pre-write state.
+	parsedTxs := []*parsedTx{
+		rwTx(0, []string{"K"}, nil),
+		rwTx(1, nil, []string{"K"}),
+	}
+
+	dependsOn := buildKeyDependencyGraph(parsedTxs)
+
+	if !dependsOnIndex(dependsOn, 1, 0) {
+		t.Fatalf("expected tx1 (writer of K) to depend on tx0 (reader of K), got %v", dependsOn)
+	}
+}
+
+func TestBuildKeyDependencyGraphWARMultipleReaders(t *testing.T) {
+	// tx0 and tx1 both read K with no intervening write, then tx2 writes K.
+	// Two readers of the same key never depend on each other, so without an
+	// edge to *every* reader since K's last writer, tx2 would only wait on
+	// tx1 (the last reader added) - tx0 could still be unvalidated, or even
+	// unscheduled, when tx2's write lands in the shared updates batch.
+	parsedTxs := []*parsedTx{
+		rwTx(0, []string{"K"}, nil),
+		rwTx(1, []string{"K"}, nil),
+		rwTx(2, nil, []string{"K"}),
+	}
+
+	dependsOn := buildKeyDependencyGraph(parsedTxs)
+
+	if !dependsOnIndex(dependsOn, 2, 0) {
+		t.Fatalf("expected tx2 (writer of K) to depend on tx0 (earlier reader of K), got %v", dependsOn)
+	}
+	if !dependsOnIndex(dependsOn, 2, 1) {
+		t.Fatalf("expected tx2 (writer of K) to depend on tx1 (later reader of K), got %v", dependsOn)
+	}
+}
+
+func TestBuildKeyDependencyGraphReadersAfterWriterDontInheritEarlierReaders(t *testing.T) {
+	// tx0 reads K, tx1 writes K (so tx1 depends on tx0), tx2 reads K again.
+	// tx2 only needs a RAW edge to tx1 (the writer whose value it reads) -
+	// the reader set for K must reset once tx1 writes, or later dependents
+	// of K would accumulate spurious edges back to readers a writer has
+	// already been ordered after.
+	parsedTxs := []*parsedTx{
+		rwTx(0, []string{"K"}, nil),
+		rwTx(1, nil, []string{"K"}),
+		rwTx(2, []string{"K"}, nil),
+	}
+
+	dependsOn := buildKeyDependencyGraph(parsedTxs)
+
+	if !dependsOnIndex(dependsOn, 2, 1) {
+		t.Fatalf("expected tx2 (reader of K) to depend on tx1 (writer of K), got %v", dependsOn)
+	}
+	if dependsOnIndex(dependsOn, 2, 0) {
+		t.Fatalf("expected tx2 not to depend on tx0, a reader superseded by tx1's write, got %v", dependsOn)
+	}
+}
+
+func TestBuildKeyDependencyGraphRAWAndWAW(t *testing.T) {
+	parsedTxs := []*parsedTx{
+		rwTx(0, nil, []string{"K"}),
+		rwTx(1, []string{"K"}, nil),
+		rwTx(2, nil, []string{"K"}),
+	}
+
+	dependsOn := buildKeyDependencyGraph(parsedTxs)
+
+	if !dependsOnIndex(dependsOn, 1, 0) {
+		t.Fatalf("expected tx1 (reader of K) to depend on tx0 (writer of K), got %v", dependsOn)
+	}
+	if !dependsOnIndex(dependsOn, 2, 0) {
+		t.Fatalf("expected tx2 (writer of K) to depend on tx0 (writer of K), got %v", dependsOn)
+	}
+	if !dependsOnIndex(dependsOn, 2, 1) {
+		t.Fatalf("expected tx2 (writer of K) to depend on tx1 (reader of K), got %v", dependsOn)
+	}
+}
+
+// TestChaincodeActionPayloadBytesUnwrapsOuterTransaction guards against
+// forwarding the marshaled peer.Transaction itself to a PluginDispatcher: a
+// real VSCC-style implementation expects the inner ChaincodeActionPayload of
+// the transaction's first action, one level further in, not the envelope
+// payload's raw Data.
+func TestChaincodeActionPayloadBytesUnwrapsOuterTransaction(t *testing.T) {
+	ccActionPayload := &peer.ChaincodeActionPayload{Action: &peer.ChaincodeEndorsedAction{}}
+	ccActionPayloadBytes, err := proto.Marshal(ccActionPayload)
+	if err != nil {
+		t.Fatalf("failed to marshal chaincode action payload: %s", err)
+	}
+	tx := &peer.Transaction{
+		Actions: []*peer.TransactionAction{{Payload: ccActionPayloadBytes}},
+	}
+	txBytes, err := proto.Marshal(tx)
+	if err != nil {
+		t.Fatalf("failed to marshal transaction: %s", err)
+	}
+
+	got, err := chaincodeActionPayloadBytes(txBytes)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(got, ccActionPayloadBytes) {
+		t.Fatalf("expected the inner ChaincodeActionPayload bytes %x, got the outer transaction's %x", ccActionPayloadBytes, got)
+	}
+}
+
+// TestChaincodeActionPayloadBytesRejectsNoActions covers a transaction with
+// no actions: there is nothing to dispatch, so this must be reported as an
+// error rather than silently forwarding an empty payload that a dispatcher
+// could mistake for a valid, zero-value result.
+func TestChaincodeActionPayloadBytesRejectsNoActions(t *testing.T) {
+	txBytes, err := proto.Marshal(&peer.Transaction{})
+	if err != nil {
+		t.Fatalf("failed to marshal transaction: %s", err)
+	}
+
+	if _, err := chaincodeActionPayloadBytes(txBytes); err == nil {
+		t.Fatalf("expected an error for a transaction with no actions, got nil")
+	}
+}
+
+func TestBuildKeyDependencyGraphPostOrderBarrier(t *testing.T) {
+	// tx0 and tx1 touch disjoint keys, so neither depends on the other and
+	// both may run fully concurrently. tx2 is a post-order barrier and must
+	// wait for both of them, not just the immediately preceding tx1.
+	parsedTxs := []*parsedTx{
+		rwTx(0, nil, []string{"A"}),
+		rwTx(1, nil, []string{"B"}),
+		postOrderTx(2),
+		rwTx(3, nil, []string{"C"}),
+	}
+
+	dependsOn := buildKeyDependencyGraph(parsedTxs)
+
+	if !dependsOnIndex(dependsOn, 2, 0) {
+		t.Fatalf("expected barrier tx2 to depend on tx0, got %v", dependsOn)
+	}
+	if !dependsOnIndex(dependsOn, 2, 1) {
+		t.Fatalf("expected barrier tx2 to depend on tx1, got %v", dependsOn)
+	}
+	if !dependsOnIndex(dependsOn, 3, 2) {
+		t.Fatalf("expected tx3 following the barrier to depend on tx2, got %v", dependsOn)
+	}
+}
+
+// fakeTxSimulator satisfies ledger.TxSimulator by embedding a nil instance of
+// it and overriding only Done(): validatePostOrderTx calls nothing else on
+// the simulator it gets back from the provider, and PostOrderValidator.Validate
+// in these tests doesn't either, so there's no need to stub the rest of the
+// (large) interface.
+type fakeTxSimulator struct {
+	ledger.TxSimulator
+	done bool
+}
+
+func (f *fakeTxSimulator) Done() {
+	f.done = true
+}
+
+// fakePostOrderSimulatorProvider records, for every txid it is asked for a
+// simulator, the updates batch it was handed - this is what lets the tests
+// below catch a regression of the bug fixed by threading updates through
+// PostOrderSimulatorProvider.NewTxSimulator.
+type fakePostOrderSimulatorProvider struct {
+	simulator   *fakeTxSimulator
+	updatesSeen map[string]*statedb.UpdateBatch
+}
+
+func (f *fakePostOrderSimulatorProvider) NewTxSimulator(txid string, updates *statedb.UpdateBatch) (ledger.TxSimulator, error) {
+	if f.updatesSeen == nil {
+		f.updatesSeen = map[string]*statedb.UpdateBatch{}
+	}
+	f.updatesSeen[txid] = updates
+	if f.simulator == nil {
+		f.simulator = &fakeTxSimulator{}
+	}
+	return f.simulator, nil
+}
+
+// fakePostOrderValidator simulates a non-endorser transaction by simply
+// returning the rwset/code/error it was configured with, recording the
+// simulator it was handed so tests can assert it's the same one the
+// provider built.
+type fakePostOrderValidator struct {
+	txRWSet      *rwsetutil.TxRwSet
+	code         peer.TxValidationCode
+	err          error
+	gotSimulator ledger.TxSimulator
+}
+
+func (f *fakePostOrderValidator) Validate(txType common.HeaderType, envBytes []byte, simulator ledger.TxSimulator) (*rwsetutil.TxRwSet, peer.TxValidationCode, error) {
+	f.gotSimulator = simulator
+	return f.txRWSet, f.code, f.err
+}
+
+// postOrderParsedTx builds a parsedTx for the post-order path, mirroring what
+// parseTx produces for a non-endorser transaction type with a registered
+// PostOrderValidator.
+func postOrderParsedTx(txIndex int, txid string, txType common.HeaderType) *parsedTx {
+	return &parsedTx{
+		txIndex:   txIndex,
+		chdr:      &common.ChannelHeader{TxId: txid},
+		txType:    txType,
+		postOrder: true,
+		envBytes:  []byte("env-" + txid),
+	}
+}
+
+// TestValidateAndCommitConcurrentlyFoldsPostOrderWriteSet covers the actual
+// hook behavior of validatePostOrderTx/PostOrderSimulatorProvider end to end,
+// not just the dependency-graph barrier scheduling covered elsewhere in this
+// file: a fake PostOrderValidator's returned TxRwSet must be folded into
+// updates exactly as an endorser transaction's would be, the simulator it
+// validates against must be built from the same in-block updates batch the
+// rest of the block is validating against (the bug fixed in
+// threading updates through NewTxSimulator), and the transaction must end up
+// marked valid in txsFilter.
+func TestValidateAndCommitConcurrentlyFoldsPostOrderWriteSet(t *testing.T) {
+	const configUpdateType = common.HeaderType_CONFIG_UPDATE
+
+	writeRWSet := &rwsetutil.TxRwSet{
+		NsRwSets: []*rwsetutil.NsRwSet{{
+			NameSpace: "ns",
+			KvRwSet:   &kvrwset.KVRWSet{Writes: []*kvrwset.KVWrite{{Key: "K", Value: []byte("v")}}},
+		}},
+	}
+	provider := &fakePostOrderSimulatorProvider{}
+	postOrderValidator := &fakePostOrderValidator{txRWSet: writeRWSet, code: peer.TxValidationCode_VALID}
+
+	v := &Validator{
+		postOrderSimulatorProvider: provider,
+		postOrderValidators:        map[common.HeaderType]PostOrderValidator{configUpdateType: postOrderValidator},
+	}
+
+	parsedTxs := []*parsedTx{postOrderParsedTx(0, "tx0", configUpdateType)}
+	updates := statedb.NewUpdateBatch()
+	txsFilter := util.NewTxValidationFlags(1)
+	block := &common.Block{Header: &common.BlockHeader{Number: 1}}
+
+	if err := v.validateAndCommitConcurrently(block, parsedTxs, true, updates, txsFilter, 4); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !updates.Exists("ns", "K") {
+		t.Fatalf("expected the post-order validator's write-set to be folded into updates")
+	}
+	if txsFilter.IsInvalid(0) {
+		t.Fatalf("expected tx0 to be marked valid, got code %v", txsFilter.Flag(0))
+	}
+	if provider.updatesSeen["tx0"] != updates {
+		t.Fatalf("expected NewTxSimulator to be handed the block's own updates batch, not a different one")
+	}
+	if postOrderValidator.gotSimulator != provider.simulator {
+		t.Fatalf("expected the post-order validator to simulate against the simulator the provider built")
+	}
+}
+
+// TestValidateAndCommitConcurrentlyAppliesPostOrderRejectionCode covers a
+// PostOrderValidator rejecting a transaction: its returned code must end up
+// in txsFilter exactly as an MVCC-rejected endorser transaction's would,
+// and nothing from it should be folded into updates.
+func TestValidateAndCommitConcurrentlyAppliesPostOrderRejectionCode(t *testing.T) {
+	const configUpdateType = common.HeaderType_CONFIG_UPDATE
+
+	writeRWSet := &rwsetutil.TxRwSet{
+		NsRwSets: []*rwsetutil.NsRwSet{{
+			NameSpace: "ns",
+			KvRwSet:   &kvrwset.KVRWSet{Writes: []*kvrwset.KVWrite{{Key: "K", Value: []byte("v")}}},
+		}},
+	}
+	provider := &fakePostOrderSimulatorProvider{}
+	postOrderValidator := &fakePostOrderValidator{txRWSet: writeRWSet, code: peer.TxValidationCode_INVALID_OTHER_REASON}
+
+	v := &Validator{
+		postOrderSimulatorProvider: provider,
+		postOrderValidators:        map[common.HeaderType]PostOrderValidator{configUpdateType: postOrderValidator},
+	}
+
+	parsedTxs := []*parsedTx{postOrderParsedTx(0, "tx0", configUpdateType)}
+	updates := statedb.NewUpdateBatch()
+	txsFilter := util.NewTxValidationFlags(1)
+	block := &common.Block{Header: &common.BlockHeader{Number: 1}}
+
+	if err := v.validateAndCommitConcurrently(block, parsedTxs, true, updates, txsFilter, 4); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if txsFilter.Flag(0) != peer.TxValidationCode_INVALID_OTHER_REASON {
+		t.Fatalf("expected tx0's validation code to be INVALID_OTHER_REASON, got %v", txsFilter.Flag(0))
+	}
+	if updates.Exists("ns", "K") {
+		t.Fatalf("expected nothing from the rejected post-order transaction to be folded into updates")
+	}
+}
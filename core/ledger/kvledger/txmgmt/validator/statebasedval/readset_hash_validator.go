@@ -0,0 +1,180 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statebasedval
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+)
+
+// readSetHashValidator validates a Merkle-hash-summarized read-set
+// (kvrwset.KVRWSet.ReadsMerkleSummary) by rebuilding the same tree locally,
+// using the committed version of every key it covers, and comparing it
+// against the endorser's tree at level summary.MaxLevel
+// (summary.MaxLevelHashes). Only the reads beneath a node whose hash
+// diverges are re-validated with the raw, per-key MVCC check.
+//
+// Unlike rangeQueryHashValidator, this does not re-derive the covered key set
+// by scanning the namespace - a plain read-set has no StartKey/EndKey to scan
+// over, only the individual keys the transaction happened to read - so the
+// full kvRwSet.Reads list (every key) still has to be shipped on the wire,
+// and hashLeaf still does one v.db.GetVersion lookup per key regardless of
+// how much of the tree ends up matching. What this buys is narrower than the
+// range-query case: it collapses the per-key version *comparisons* against
+// the endorser's declared versions into O(len(reads)/leavesPerNode) tree-hash
+// comparisons in the common all-match case, not the lookups themselves or the
+// read-set's size on the wire. This is an accepted, permanent limitation of
+// summarizing a point-read set rather than a range - not a gap to close
+// later - since without a key range there's nothing to re-derive the reads
+// from on the validator side.
+type readSetHashValidator struct {
+	ns      string
+	reads   []*kvrwset.KVRead
+	summary *kvrwset.QueryReadsMerkleSummary
+	v       *Validator
+	updates *statedb.UpdateBatch
+	// commitMu guards the updates.Exists lookups in hashLeaf and, through
+	// validateKVRead, in the raw fallback - the only points at which this
+	// validator touches the block-wide shared updates batch; everything else
+	// it does (version lookups, tree building/comparison)
+	// reads only the already-committed, read-only state and can run
+	// unlocked alongside other transactions validating concurrently.
+	commitMu *sync.Mutex
+}
+
+func (r *readSetHashValidator) validate() (bool, error) {
+	leafHashes := make([][]byte, len(r.reads))
+	for i, kvRead := range r.reads {
+		leafHashes[i] = r.hashLeaf(kvRead)
+	}
+
+	levelHashes, err := buildMerkleLevel(leafHashes, r.summary.MaxDegree, r.summary.MaxLevel)
+	if err != nil {
+		return false, err
+	}
+
+	if len(levelHashes) != len(r.summary.MaxLevelHashes) {
+		// The shape of the tree the endorser built doesn't match what we
+		// rebuilt from the read-set it shipped alongside the summary -
+		// fall back to validating every read raw.
+		return r.validateRawRange(0, len(r.reads))
+	}
+
+	leavesPerNode := int(merklePow(r.summary.MaxDegree, r.summary.MaxLevel))
+	for i, levelHash := range levelHashes {
+		if bytes.Equal(levelHash, r.summary.MaxLevelHashes[i]) {
+			continue
+		}
+		start := i * leavesPerNode
+		end := start + leavesPerNode
+		if valid, err := r.validateRawRange(start, end); !valid || err != nil {
+			return valid, err
+		}
+	}
+	return true, nil
+}
+
+func (r *readSetHashValidator) validateRawRange(start, end int) (bool, error) {
+	if end > len(r.reads) {
+		end = len(r.reads)
+	}
+	for _, kvRead := range r.reads[start:end] {
+		if valid, err := r.v.validateKVRead(r.ns, kvRead, r.updates, r.commitMu); !valid || err != nil {
+			return valid, err
+		}
+	}
+	return true, nil
+}
+
+// hashLeaf computes hash(namespace||key||versionBytes) for the key's
+// currently committed version. If a preceding transaction in this block has
+// already written the key, the read is invalid regardless of its committed
+// version - exactly as validateKVRead enforces on the raw path - so the leaf
+// is instead given a hash no legitimate committed version can produce. That
+// forces the enclosing subtree's hash to diverge from the endorser's, which
+// sends it through the raw fallback, where validateKVRead rejects it.
+func (r *readSetHashValidator) hashLeaf(kvRead *kvrwset.KVRead) []byte {
+	r.commitMu.Lock()
+	exists := r.updates.Exists(r.ns, kvRead.Key)
+	r.commitMu.Unlock()
+	if exists {
+		return nil
+	}
+	committedVersion, err := r.v.db.GetVersion(r.ns, kvRead.Key)
+	if err != nil {
+		committedVersion = nil
+	}
+	return hashReadSetLeaf(r.ns, kvRead.Key, committedVersion)
+}
+
+func hashReadSetLeaf(ns, key string, ver *version.Height) []byte {
+	var verBytes []byte
+	if ver != nil {
+		verBytes = []byte(ver.String())
+	}
+	data := make([]byte, 0, len(ns)+len(key)+len(verBytes))
+	data = append(data, []byte(ns)...)
+	data = append(data, []byte(key)...)
+	data = append(data, verBytes...)
+	return util.ComputeSHA256(data)
+}
+
+// buildMerkleLevel combines leafHashes, K at a time (K = fanout), for
+// `level` rounds (stopping early once a single node remains), and returns
+// the resulting row of the tree. A row whose
+// length isn't a multiple of fanout has its last node computed over the
+// remaining, shorter group, same as the range-query hash validator.
+func buildMerkleLevel(leafHashes [][]byte, fanout, level uint32) ([][]byte, error) {
+	if fanout == 0 {
+		return nil, errors.New("statebasedval: merkle fan-out (MaxDegree) must be greater than zero")
+	}
+	nodes := leafHashes
+	for l := uint32(0); l < level && len(nodes) > 1; l++ {
+		var parents [][]byte
+		for i := 0; i < len(nodes); i += int(fanout) {
+			end := i + int(fanout)
+			if end > len(nodes) {
+				end = len(nodes)
+			}
+			parents = append(parents, hashMerkleChildren(nodes[i:end]))
+		}
+		nodes = parents
+	}
+	return nodes, nil
+}
+
+func hashMerkleChildren(children [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, child := range children {
+		buf.Write(child)
+	}
+	return util.ComputeSHA256(buf.Bytes())
+}
+
+func merklePow(base, exp uint32) uint32 {
+	result := uint32(1)
+	for i := uint32(0); i < exp; i++ {
+		result *= base
+	}
+	return result
+}
@@ -0,0 +1,220 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statebasedval
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+)
+
+// TestHashLeafRejectsSameBlockWrite ensures a key already written by a
+// preceding transaction in the block never hashes to a value a legitimate
+// committed version could also produce - otherwise a Merkle root built over
+// it could coincidentally agree with the endorser's and hide the conflict
+// that the raw fallback (validateKVRead) would have caught.
+func TestHashLeafRejectsSameBlockWrite(t *testing.T) {
+	updates := statedb.NewUpdateBatch()
+	updates.Put("ns", "K", []byte("v"), version.NewHeight(1, 0))
+
+	r := &readSetHashValidator{
+		ns:       "ns",
+		v:        &Validator{},
+		updates:  updates,
+		commitMu: &sync.Mutex{},
+	}
+
+	leaf := r.hashLeaf(&kvrwset.KVRead{Key: "K", Version: &kvrwset.Version{BlockNum: 1, TxNum: 0}})
+	if leaf != nil {
+		t.Fatalf("expected a nil leaf hash for a key written earlier in the block, got %x", leaf)
+	}
+}
+
+// TestHashLeafDistinguishesConflictingFromAbsentVersion guards against
+// collapsing the "written earlier in this block" marker with the hash of a
+// key that simply has no committed version yet (ver == nil).
+func TestHashLeafDistinguishesConflictingFromAbsentVersion(t *testing.T) {
+	conflicted := &readSetHashValidator{ns: "ns", v: &Validator{}, updates: statedb.NewUpdateBatch(), commitMu: &sync.Mutex{}}
+	conflicted.updates.Put("ns", "K", []byte("v"), version.NewHeight(1, 0))
+	conflictLeaf := conflicted.hashLeaf(&kvrwset.KVRead{Key: "K"})
+
+	absentVersionLeaf := hashReadSetLeaf("ns", "K", nil)
+
+	if bytes.Equal(conflictLeaf, absentVersionLeaf) {
+		t.Fatalf("same-block-write marker must not equal the hash of an absent committed version")
+	}
+}
+
+// conflictingReadSetValidator builds a readSetHashValidator over n reads
+// (single-letter keys "A", "B", ...), all pre-populated into updates so every one of them takes
+// hashLeaf's in-block-conflict marker path - this keeps leaf hashing fully
+// deterministic and independent of v.db, which the tests below leave nil.
+func conflictingReadSetValidator(n int, summary *kvrwset.QueryReadsMerkleSummary) *readSetHashValidator {
+	updates := statedb.NewUpdateBatch()
+	reads := make([]*kvrwset.KVRead, n)
+	for i := 0; i < n; i++ {
+		key := string(rune('A' + i))
+		updates.Put("ns", key, []byte("v"), version.NewHeight(1, 0))
+		reads[i] = &kvrwset.KVRead{Key: key}
+	}
+	return &readSetHashValidator{
+		ns:       "ns",
+		reads:    reads,
+		summary:  summary,
+		v:        &Validator{},
+		updates:  updates,
+		commitMu: &sync.Mutex{},
+	}
+}
+
+// TestReadSetHashValidatorValidateMatchingRoot covers the common case: the
+// tree rebuilt locally matches the endorser's summary at every node, so
+// validate() must return valid without falling back to a single raw
+// validateKVRead check - every read in this test is an in-block conflict, so
+// any (even partial) fallback would flip the result to invalid.
+func TestReadSetHashValidatorValidateMatchingRoot(t *testing.T) {
+	r := conflictingReadSetValidator(4, &kvrwset.QueryReadsMerkleSummary{MaxDegree: 2, MaxLevel: 1})
+	leafHashes := make([][]byte, len(r.reads))
+	levelHashes, err := buildMerkleLevel(leafHashes, r.summary.MaxDegree, r.summary.MaxLevel)
+	if err != nil {
+		t.Fatalf("unexpected error building the expected tree: %s", err)
+	}
+	r.summary.MaxLevelHashes = levelHashes
+
+	valid, err := r.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !valid {
+		t.Fatalf("expected a matching root to validate without any raw fallback, got invalid")
+	}
+}
+
+// TestReadSetHashValidatorValidateDivergentSubtree covers a single node of
+// the tree disagreeing with the endorser's summary: validate() must fall
+// back to a raw check of the reads beneath that node and report whatever
+// that check finds (here, an in-block conflict).
+func TestReadSetHashValidatorValidateDivergentSubtree(t *testing.T) {
+	r := conflictingReadSetValidator(4, &kvrwset.QueryReadsMerkleSummary{MaxDegree: 2, MaxLevel: 1})
+	leafHashes := make([][]byte, len(r.reads))
+	levelHashes, err := buildMerkleLevel(leafHashes, r.summary.MaxDegree, r.summary.MaxLevel)
+	if err != nil {
+		t.Fatalf("unexpected error building the expected tree: %s", err)
+	}
+	levelHashes[0] = []byte("a-hash-the-real-tree-would-never-produce")
+	r.summary.MaxLevelHashes = levelHashes
+
+	valid, err := r.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if valid {
+		t.Fatalf("expected the raw fallback over the divergent node's reads to surface the in-block conflict")
+	}
+}
+
+// TestReadSetHashValidatorValidateShapeMismatch covers the summary's level
+// count not matching what was rebuilt from the read-set - e.g. the endorser
+// and validator disagreeing on MaxDegree/MaxLevel. validate() must fall back
+// to validating every read raw rather than comparing incompatible trees.
+func TestReadSetHashValidatorValidateShapeMismatch(t *testing.T) {
+	r := conflictingReadSetValidator(4, &kvrwset.QueryReadsMerkleSummary{
+		MaxDegree:      2,
+		MaxLevel:       1,
+		MaxLevelHashes: [][]byte{[]byte("only-one-entry-for-a-four-leaf-tree")},
+	})
+
+	valid, err := r.validate()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if valid {
+		t.Fatalf("expected a shape mismatch to fall back to the raw check and surface the in-block conflict")
+	}
+}
+
+// TestValidateRawRangeOnlyValidatesGivenRange is the regression test behind
+// the divergent-subtree fallback: validateRawRange must check only the
+// reads in [start, end), not the full read-set. reads[0:2] are deliberately
+// left out of updates with v.db left nil, so touching them would panic;
+// reads[2:4] are in-block conflicts that validateKVRead rejects immediately
+// without needing v.db. A call restricted to [2, 4) must therefore return
+// invalid without panicking.
+func TestValidateRawRangeOnlyValidatesGivenRange(t *testing.T) {
+	updates := statedb.NewUpdateBatch()
+	updates.Put("ns", "C0", []byte("v"), version.NewHeight(1, 0))
+	updates.Put("ns", "C1", []byte("v"), version.NewHeight(1, 0))
+
+	r := &readSetHashValidator{
+		ns: "ns",
+		reads: []*kvrwset.KVRead{
+			{Key: "M0"},
+			{Key: "M1"},
+			{Key: "C0"},
+			{Key: "C1"},
+		},
+		v:        &Validator{},
+		updates:  updates,
+		commitMu: &sync.Mutex{},
+	}
+
+	valid, err := r.validateRawRange(2, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if valid {
+		t.Fatalf("expected the in-block conflicts in [2,4) to be rejected")
+	}
+}
+
+func TestMerklePow(t *testing.T) {
+	if got := merklePow(2, 3); got != 8 {
+		t.Fatalf("expected 2^3 = 8, got %d", got)
+	}
+	if got := merklePow(5, 0); got != 1 {
+		t.Fatalf("expected base^0 = 1, got %d", got)
+	}
+}
+
+func TestBuildMerkleLevel(t *testing.T) {
+	leaves := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+
+	got, err := buildMerkleLevel(leaves, 2, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := [][]byte{hashMerkleChildren(leaves[0:2]), hashMerkleChildren(leaves[2:4])}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d level hashes, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("level hash %d mismatch: got %x, want %x", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBuildMerkleLevelZeroFanoutErrors(t *testing.T) {
+	if _, err := buildMerkleLevel([][]byte{[]byte("a")}, 0, 1); err == nil {
+		t.Fatalf("expected an error for a zero fan-out")
+	}
+}
@@ -17,12 +17,14 @@ limitations under the License.
 package statebasedval
 
 import (
-	"os"
+	"sync"
 	"time"
 
-	"fmt"
-
 	"github.com/hyperledger/fabric/common/flogging"
+	"github.com/hyperledger/fabric/common/metrics"
+	commonutil "github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/ledger"
+	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/privacyenabledstate"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/rwsetutil"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/statedb"
 	"github.com/hyperledger/fabric/core/ledger/kvledger/txmgmt/version"
@@ -30,150 +32,181 @@ import (
 	"github.com/hyperledger/fabric/protos/common"
 	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
 	"github.com/hyperledger/fabric/protos/peer"
-	putils "github.com/hyperledger/fabric/protos/utils"
 )
 
-var state_based_validator_log, _ = os.Create("/root/state_based_validator.log")
-
 var logger = flogging.MustGetLogger("statevalidator")
 
-// Validator validates a tx against the latest committed state
-// and preceding valid transactions with in the same block
-type Validator struct {
-	db statedb.VersionedDB
+// HashedCompositeKey encapsulates the namespace, collection name and key hash
+// that together identify a hashed key/value entry of a private collection in
+// the hashed portion of the state database
+type HashedCompositeKey struct {
+	Namespace      string
+	CollectionName string
+	KeyHash        string
 }
 
-// NewValidator constructs StateValidator
-func NewValidator(db statedb.VersionedDB) *Validator {
-	return &Validator{db}
+// PostOrderSimulatorProvider supplies a TxSimulator for a given txid so that
+// non-endorser transaction types can be re-simulated against the ledger state
+// as it stands part-way through block validation, rather than against the
+// final committed state. updates carries every write folded in so far by
+// preceding transactions in the same block (the dependency graph guarantees
+// no further writes land in it while this call is in flight); an
+// implementation must layer updates over the last-committed state when
+// building the simulator; reading only the committed state would give
+// post-order transactions that follow an endorser write, or another
+// post-order transaction, a stale view of keys written earlier in the block.
+type PostOrderSimulatorProvider interface {
+	NewTxSimulator(txid string, updates *statedb.UpdateBatch) (ledger.TxSimulator, error)
 }
 
-//validate endorser transaction
-func (v *Validator) validateEndorserTX(envBytes []byte, doMVCCValidation bool, updates *statedb.UpdateBatch) (*rwsetutil.TxRwSet, peer.TxValidationCode, error) {
-	// extract actions from the envelope message
-	respPayload, err := putils.GetActionFromEnvelope(envBytes)
-	if err != nil {
-		return nil, peer.TxValidationCode_NIL_TXACTION, nil
-	}
+// PostOrderValidator simulates a non-endorser transaction (e.g. a config
+// update or a token transaction) against the supplied simulator and returns
+// the read/write set it produced, to be merged into the block's UpdateBatch
+// exactly as an endorser transaction's read/write set would be.
+type PostOrderValidator interface {
+	Validate(txType common.HeaderType, envBytes []byte, simulator ledger.TxSimulator) (*rwsetutil.TxRwSet, peer.TxValidationCode, error)
+}
 
-	//preparation for extracting RWSet from transaction
-	txRWSet := &rwsetutil.TxRwSet{}
+// PluginDispatcher evaluates endorsement-policy (VSCC) validation for a
+// single endorser transaction, independent of this package's own MVCC
+// checks. It mirrors the dispatch step of Fabric's
+// txvalidator/v20/plugindispatcher, letting an operator plug in custom VSCC
+// implementations - chaincode-specific policies, token-VSCC, ABAC - without
+// touching the state validator. seq is the transaction's index within
+// block; payload is the marshaled ChaincodeActionPayload of the transaction's
+// first action - not the outer peer.Transaction that wraps it.
+type PluginDispatcher interface {
+	Dispatch(seq int, payload []byte, envBytes []byte, block *common.Block) (peer.TxValidationCode, error)
+}
 
-	// Get the Result from the Action
-	// and then Unmarshal it into a TxReadWriteSet using custom unmarshalling
+// Validator validates a tx against the latest committed state
+// and preceding valid transactions with in the same block
+type Validator struct {
+	db                         privacyenabledstate.DB
+	config                     *ValidatorConfig
+	postOrderSimulatorProvider PostOrderSimulatorProvider
+	postOrderValidators        map[common.HeaderType]PostOrderValidator
+	pluginDispatcher           PluginDispatcher
+	metrics                    *Metrics
+}
 
-	if err = txRWSet.FromProtoBytes(respPayload.Results); err != nil {
-		return nil, peer.TxValidationCode_INVALID_OTHER_REASON, nil
+// Option customizes a Validator constructed by NewValidator.
+type Option func(*Validator)
+
+// WithPluginDispatcher registers a PluginDispatcher to run endorsement-policy
+// validation ahead of the MVCC step for every ENDORSER_TRANSACTION in a
+// block. A transaction it rejects is marked with the returned
+// TxValidationCode (e.g. ENDORSEMENT_POLICY_FAILURE) and excluded from
+// write-set application, exactly like a transaction that fails MVCC
+// validation.
+func WithPluginDispatcher(d PluginDispatcher) Option {
+	return func(v *Validator) {
+		v.pluginDispatcher = d
 	}
+}
 
-	txResult := peer.TxValidationCode_VALID
+// NewValidator constructs StateValidator. postOrderSimulatorProvider and
+// postOrderValidators may be nil, in which case non-endorser transaction
+// types continue to be skipped, as before. metricsProvider may also be nil,
+// in which case the validator's measurements are simply discarded. opts may
+// be used to set a PluginDispatcher; omitting it continues to skip
+// endorsement-policy validation, as before.
+func NewValidator(
+	db privacyenabledstate.DB,
+	config *ValidatorConfig,
+	postOrderSimulatorProvider PostOrderSimulatorProvider,
+	postOrderValidators map[common.HeaderType]PostOrderValidator,
+	metricsProvider metrics.Provider,
+	opts ...Option,
+) *Validator {
+	v := &Validator{
+		db:                         db,
+		config:                     config,
+		postOrderSimulatorProvider: postOrderSimulatorProvider,
+		postOrderValidators:        postOrderValidators,
+		metrics:                    NewMetrics(metricsProvider),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
 
-	//mvccvalidation, may invalidate transaction
-	if doMVCCValidation {
-		if txResult, err = v.validateTx(txRWSet, updates); err != nil {
-			return nil, txResult, err
-		} else if txResult != peer.TxValidationCode_VALID {
-			txRWSet = nil
+// readSetOf collects the bulk-load key set - public and hashed - declared by
+// a block's already-parsed transactions. It is built from the parsedTxs that
+// parseBlockForValidation produced, rather than re-parsing the block's
+// envelopes, so the one parallel parse pass feeds both the bulk version
+// load and MVCC validation instead of two independent passes over the same
+// transactions, one of them single-threaded.
+func readSetOf(parsedTxs []*parsedTx) ([]*statedb.CompositeKey, []*HashedCompositeKey) {
+	var readSet []*statedb.CompositeKey
+	var hashedReadSet []*HashedCompositeKey
+
+	for _, parsed := range parsedTxs {
+		if parsed == nil || parsed.txRWSet == nil {
+			continue
+		}
+		for _, nsRWSet := range parsed.txRWSet.NsRwSets {
+			for _, kvRead := range nsRWSet.KvRwSet.Reads {
+				readSet = append(readSet, &statedb.CompositeKey{
+					Namespace: nsRWSet.NameSpace,
+					Key:       kvRead.Key,
+				})
+			}
+			for _, collHashedRWSet := range nsRWSet.CollHashedRwSets {
+				for _, kvReadHash := range collHashedRWSet.HashedRwSet.HashedReads {
+					hashedReadSet = append(hashedReadSet, &HashedCompositeKey{
+						Namespace:      nsRWSet.NameSpace,
+						CollectionName: collHashedRWSet.CollectionName,
+						KeyHash:        string(kvReadHash.KeyHash),
+					})
+				}
+			}
 		}
 	}
-
-	return txRWSet, txResult, err
+	return readSet, hashedReadSet
 }
 
-func (v *Validator) collectRSetForBlockForBulkOptimizable(blocks []*common.Block) error {
+// loadCommittedVersionsForBulkOptimizable warms v.db's version cache, if it
+// supports statedb.BulkOptimizable, with every key read across
+// perBlockParsedTxs in a single call, ahead of the per-tx v.db.GetVersion
+// calls MVCC validation is about to make.
+func (v *Validator) loadCommittedVersionsForBulkOptimizable(perBlockParsedTxs [][]*parsedTx) {
 	bulkOptimizable, ok := v.db.(statedb.BulkOptimizable)
 	if !ok {
-		return nil
+		return
 	}
 
 	var totalReadSet []*statedb.CompositeKey
+	var totalHashedReadSet []*HashedCompositeKey
+	for _, parsedTxs := range perBlockParsedTxs {
+		readSet, hashedReadSet := readSetOf(parsedTxs)
+		totalReadSet = append(totalReadSet, readSet...)
+		totalHashedReadSet = append(totalHashedReadSet, hashedReadSet...)
+	}
 
-	for _, block := range blocks {
-		// Committer validator has already set validation flags based on well formed tran checks
-		txsFilter := util.TxValidationFlags(block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER])
-
-		// Precaution in case committer validator has not added validation flags yet
-		if len(txsFilter) == 0 {
-			txsFilter = util.NewTxValidationFlags(len(block.Data.Data))
-			block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilter
-		}
-
-		for txIndex, envBytes := range block.Data.Data {
-			if txsFilter.IsInvalid(txIndex) {
-				// Skiping invalid transaction
-				logger.Warningf("Block [%d] Transaction index [%d] marked as invalid by committer. Reason code [%d]",
-					block.Header.Number, txIndex, txsFilter.Flag(txIndex))
-				continue
-			}
-
-			env, err := putils.GetEnvelopeFromBlock(envBytes)
-			if err != nil {
-				return err
-			}
-
-			payload, err := putils.GetPayload(env)
-			if err != nil {
-				return err
-			}
-
-			chdr, err := putils.UnmarshalChannelHeader(payload.Header.ChannelHeader)
-			if err != nil {
-				return err
-			}
-
-			txType := common.HeaderType(chdr.Type)
-
-			if txType != common.HeaderType_ENDORSER_TRANSACTION {
-				//			logger.Debugf("Skipping mvcc validation for Block [%d] Transaction index [%d] because, the transaction type is [%s]",
-				//				block.Header.Number, txIndex, txType)
-				continue
-			}
-
-			var txResult peer.TxValidationCode
-
-			// Get the readset
-			respPayload, err := putils.GetActionFromEnvelope(envBytes)
-			if err != nil {
-				txResult = peer.TxValidationCode_NIL_TXACTION
-			}
-			//preparation for extracting RWSet from transaction
-			txRWSet := &rwsetutil.TxRwSet{}
-			// Get the Result from the Action
-			// and then Unmarshal it into a TxReadWriteSet using custom unmarshalling
-			if err = txRWSet.FromProtoBytes(respPayload.Results); err != nil {
-				txResult = peer.TxValidationCode_INVALID_OTHER_REASON
-			}
-
-			txsFilter.SetFlag(txIndex, txResult)
-
-			//txRWSet != nil => t is valid
-			if txRWSet != nil {
-				for _, nsRWSet := range txRWSet.NsRwSets {
-					for _, kvRead := range nsRWSet.KvRwSet.Reads {
-						totalReadSet = append(totalReadSet, &statedb.CompositeKey{
-							Namespace: nsRWSet.NameSpace,
-							Key:       kvRead.Key,
-						})
-					}
-				}
-			}
+	bulkOptimizable.LoadCommittedVersions(append(totalReadSet, hashedKeysToCompositeKeys(totalHashedReadSet)...))
+}
 
+// hashedKeysToCompositeKeys maps hashed private-data reads onto the composite-key
+// space of the underlying public store so that a single BulkOptimizable call can
+// warm the version cache for both the public and the hashed reads of a block. Hashed
+// key/value pairs for a given collection live in the store under the namespace
+// derived by privacyenabledstate for that namespace/collection pair, keyed by the
+// hash of the private key rather than the key itself.
+func hashedKeysToCompositeKeys(hashedKeys []*HashedCompositeKey) []*statedb.CompositeKey {
+	compositeKeys := make([]*statedb.CompositeKey, len(hashedKeys))
+	for i, hashedKey := range hashedKeys {
+		compositeKeys[i] = &statedb.CompositeKey{
+			Namespace: privacyenabledstate.DeriveHashedDataNs(hashedKey.Namespace, hashedKey.CollectionName),
+			Key:       hashedKey.KeyHash,
 		}
-		block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilter
 	}
-
-	bulkOptimizable.LoadCommittedVersions(totalReadSet)
-	return nil
+	return compositeKeys
 }
 
 // ValidateAndPrepareBatch implements method in Validator interface
 func (v *Validator) ValidateAndPrepareBatch(block *common.Block, doMVCCValidation bool) (*statedb.UpdateBatch, error) {
-	startTime := time.Now()
-	state_based_validator_log.WriteString(fmt.Sprintf("%s ValidateAndPrepareBatch start\n", startTime))
-	defer func(startTime time.Time) {
-		state_based_validator_log.WriteString(fmt.Sprintf("%s ValidateAndPrepareBatch end %d\n", time.Now(), time.Now().Sub(startTime).Nanoseconds()))
-	}(startTime)
-
 	logger.Debugf("New block arrived for validation:%#v, doMVCCValidation=%t", block, doMVCCValidation)
 	updates := statedb.NewUpdateBatch()
 	logger.Debugf("Validating a block with [%d] transactions", len(block.Data.Data))
@@ -187,86 +220,33 @@ func (v *Validator) ValidateAndPrepareBatch(block *common.Block, doMVCCValidatio
 		block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilter
 	}
 
-	v.collectRSetForBlockForBulkOptimizable([]*common.Block{block})
-
-	for txIndex, envBytes := range block.Data.Data {
-		if txsFilter.IsInvalid(txIndex) {
-			// Skiping invalid transaction
-			logger.Warningf("Block [%d] Transaction index [%d] marked as invalid by committer. Reason code [%d]",
-				block.Header.Number, txIndex, txsFilter.Flag(txIndex))
-			continue
-		}
+	maxConcurrency := v.config.maxConcurrency()
 
-		sTime := time.Now()
-		env, err := putils.GetEnvelopeFromBlock(envBytes)
-		state_based_validator_log.WriteString(fmt.Sprintf("%s GetEnvelopeFromBlock done %d\n", time.Now(), time.Now().Sub(sTime).Nanoseconds()))
-		if err != nil {
-			return nil, err
-		}
-
-		payload, err := putils.GetPayload(env)
-		if err != nil {
-			return nil, err
-		}
-
-		chdr, err := putils.UnmarshalChannelHeader(payload.Header.ChannelHeader)
-		if err != nil {
-			return nil, err
-		}
-
-		txType := common.HeaderType(chdr.Type)
-
-		if txType != common.HeaderType_ENDORSER_TRANSACTION {
-			logger.Debugf("Skipping mvcc validation for Block [%d] Transaction index [%d] because, the transaction type is [%s]",
-				block.Header.Number, txIndex, txType)
-			continue
-		}
-
-		sTime = time.Now()
-		txRWSet, txResult, err := v.validateEndorserTX(envBytes, doMVCCValidation, updates)
-		state_based_validator_log.WriteString(fmt.Sprintf("%s validateEndorserTX done %d\n", time.Now(), time.Now().Sub(sTime).Nanoseconds()))
-
-		if err != nil {
-			return nil, err
-		}
-
-		txsFilter.SetFlag(txIndex, txResult)
+	parsedTxs, err := v.parseBlockForValidation(block, txsFilter, maxConcurrency)
+	if err != nil {
+		return nil, err
+	}
 
-		//txRWSet != nil => t is valid
-		if txRWSet != nil {
-			committingTxHeight := version.NewHeight(block.Header.Number, uint64(txIndex))
-			sTime = time.Now()
-			addWriteSetToBatch(txRWSet, committingTxHeight, updates)
-			state_based_validator_log.WriteString(fmt.Sprintf("%s addWriteSetToBatch done %d\n", time.Now(), time.Now().Sub(sTime).Nanoseconds()))
-			txsFilter.SetFlag(txIndex, peer.TxValidationCode_VALID)
-		}
+	bulkLoadStart := time.Now()
+	v.loadCommittedVersionsForBulkOptimizable([][]*parsedTx{parsedTxs})
+	v.metrics.observeBulkLoadVersions(bulkLoadStart)
 
-		if txsFilter.IsValid(txIndex) {
-			logger.Debugf("Block [%d] Transaction index [%d] TxId [%s] marked as valid by state validator",
-				block.Header.Number, txIndex, chdr.TxId)
-		} else {
-			logger.Warningf("Block [%d] Transaction index [%d] TxId [%s] marked as invalid by state validator. Reason code [%d]",
-				block.Header.Number, txIndex, chdr.TxId, txsFilter.Flag(txIndex))
-		}
+	if err := v.validateAndCommitConcurrently(block, parsedTxs, doMVCCValidation, updates, txsFilter, maxConcurrency); err != nil {
+		return nil, err
 	}
+
 	block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilter
 	return updates, nil
 }
 
 // ValidateAndPrepareBatchBulk implements method in Validator interface
 func (v *Validator) ValidateAndPrepareBatchBulk(blocks []*common.Block, doMVCCValidation bool) (*statedb.UpdateBatch, []error) {
-	startTime := time.Now()
 	errs := make([]error, len(blocks))
-
-	state_based_validator_log.WriteString(fmt.Sprintf("%s ValidateAndPrepareBatchBulk start len %d\n", startTime, len(blocks)))
-	defer func(startTime time.Time) {
-		state_based_validator_log.WriteString(fmt.Sprintf("%s ValidateAndPrepareBatchBulk end %d len %d\n", time.Now(), time.Now().Sub(startTime).Nanoseconds(), len(blocks)))
-	}(startTime)
-
-	sTime := time.Now()
-	v.collectRSetForBlockForBulkOptimizable(blocks)
-	state_based_validator_log.WriteString(fmt.Sprintf("%s CollectRSet done %d\n", time.Now(), time.Now().Sub(sTime)))
 	updates := statedb.NewUpdateBatch()
+	maxConcurrency := v.config.maxConcurrency()
+
+	txsFilters := make([]util.TxValidationFlags, len(blocks))
+	perBlockParsedTxs := make([][]*parsedTx, len(blocks))
 
 	for i, block := range blocks {
 		logger.Debugf("New block arrived for validation:%#v, doMVCCValidation=%t", block, doMVCCValidation)
@@ -280,74 +260,33 @@ func (v *Validator) ValidateAndPrepareBatchBulk(blocks []*common.Block, doMVCCVa
 			txsFilter = util.NewTxValidationFlags(len(block.Data.Data))
 			block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilter
 		}
+		txsFilters[i] = txsFilter
 
-		for txIndex, envBytes := range block.Data.Data {
-			if txsFilter.IsInvalid(txIndex) {
-				// Skiping invalid transaction
-				logger.Warningf("Block [%d] Transaction index [%d] marked as invalid by committer. Reason code [%d]",
-					block.Header.Number, txIndex, txsFilter.Flag(txIndex))
-				continue
-			}
-
-			sTime := time.Now()
-			env, err := putils.GetEnvelopeFromBlock(envBytes)
-			state_based_validator_log.WriteString(fmt.Sprintf("%s GetEnvelopeFromBlock done %d\n", time.Now(), time.Now().Sub(sTime).Nanoseconds()))
-			if err != nil {
-				errs[i] = err
-				break // mark the block invalid and continue validating other blocks
-			}
-
-			payload, err := putils.GetPayload(env)
-			if err != nil {
-				errs[i] = err
-				break // mark the block invalid and continue validating other blocks
-			}
-
-			chdr, err := putils.UnmarshalChannelHeader(payload.Header.ChannelHeader)
-			if err != nil {
-				errs[i] = err
-				break // mark the block invalid and continue validating other blocks
-			}
-
-			txType := common.HeaderType(chdr.Type)
-
-			if txType != common.HeaderType_ENDORSER_TRANSACTION {
-				logger.Debugf("Skipping mvcc validation for Block [%d] Transaction index [%d] because, the transaction type is [%s]",
-					block.Header.Number, txIndex, txType)
-				continue
-			}
-
-			sTime = time.Now()
-			txRWSet, txResult, err := v.validateEndorserTX(envBytes, doMVCCValidation, updates)
-			state_based_validator_log.WriteString(fmt.Sprintf("%s validateEndorserTX done %d\n", time.Now(), time.Now().Sub(sTime).Nanoseconds()))
-
-			if err != nil {
-				errs[i] = err
-				break // mark the block invalid and continue validating other blocks
-			}
+		parsedTxs, err := v.parseBlockForValidation(block, txsFilter, maxConcurrency)
+		if err != nil {
+			errs[i] = err
+			// if the block is invalid, it'll be ignored by the caller
+			block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilter
+			continue // mark the block invalid and continue validating other blocks
+		}
+		perBlockParsedTxs[i] = parsedTxs
+	}
 
-			txsFilter.SetFlag(txIndex, txResult)
+	bulkLoadStart := time.Now()
+	v.loadCommittedVersionsForBulkOptimizable(perBlockParsedTxs)
+	v.metrics.observeBulkLoadVersions(bulkLoadStart)
 
-			//txRWSet != nil => t is valid
-			if txRWSet != nil {
-				committingTxHeight := version.NewHeight(block.Header.Number, uint64(txIndex))
-				sTime = time.Now()
-				addWriteSetToBatch(txRWSet, committingTxHeight, updates)
-				state_based_validator_log.WriteString(fmt.Sprintf("%s addWriteSetToBatch done %d\n", time.Now(), time.Now().Sub(sTime).Nanoseconds()))
-				txsFilter.SetFlag(txIndex, peer.TxValidationCode_VALID)
-			}
+	for i, block := range blocks {
+		if errs[i] != nil || perBlockParsedTxs[i] == nil {
+			continue
+		}
 
-			if txsFilter.IsValid(txIndex) {
-				logger.Debugf("Block [%d] Transaction index [%d] TxId [%s] marked as valid by state validator",
-					block.Header.Number, txIndex, chdr.TxId)
-			} else {
-				logger.Warningf("Block [%d] Transaction index [%d] TxId [%s] marked as invalid by state validator. Reason code [%d]",
-					block.Header.Number, txIndex, chdr.TxId, txsFilter.Flag(txIndex))
-			}
+		if err := v.validateAndCommitConcurrently(block, perBlockParsedTxs[i], doMVCCValidation, updates, txsFilters[i], maxConcurrency); err != nil {
+			errs[i] = err
 		}
 
 		// if the block is invalid, it'll be ignored by the caller
-		block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilter
+		block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = txsFilters[i]
 	}
 
 	return updates, errs
@@ -363,32 +302,80 @@ func addWriteSetToBatch(txRWSet *rwsetutil.TxRwSet, txHeight *version.Height, ba
 				batch.Put(ns, kvWrite.Key, kvWrite.Value, txHeight)
 			}
 		}
+		for _, collHashedRWSet := range nsRWSet.CollHashedRwSets {
+			hashedNs := privacyenabledstate.DeriveHashedDataNs(ns, collHashedRWSet.CollectionName)
+			for _, kvWriteHash := range collHashedRWSet.HashedRwSet.HashedWrites {
+				keyHash := string(kvWriteHash.KeyHash)
+				if kvWriteHash.IsDelete {
+					batch.Delete(hashedNs, keyHash, txHeight)
+				} else {
+					batch.Put(hashedNs, keyHash, kvWriteHash.ValueHash, txHeight)
+				}
+			}
+		}
 	}
 }
 
-func (v *Validator) validateTx(txRWSet *rwsetutil.TxRwSet, updates *statedb.UpdateBatch) (peer.TxValidationCode, error) {
+// validateTx runs the full MVCC check for a single transaction's read/write
+// set against updates. commitMu guards the individual lookups of updates
+// performed along the way (see validateKVRead and
+// validateHashedKVRead) - not the surrounding v.db.GetVersion calls or
+// Merkle-tree rebuilding, which touch only the already-committed, read-only
+// state and can safely run unlocked alongside other transactions'
+// validation. validateRangeQuery is the exception: it holds commitMu for
+// its entire scan of updates rather than just a single lookup (see its doc
+// comment for why).
+func (v *Validator) validateTx(txRWSet *rwsetutil.TxRwSet, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (peer.TxValidationCode, error) {
 	for _, nsRWSet := range txRWSet.NsRwSets {
 		ns := nsRWSet.NameSpace
 
-		if valid, err := v.validateReadSet(ns, nsRWSet.KvRwSet.Reads, updates); !valid || err != nil {
+		if valid, err := v.validateReadSet(ns, nsRWSet.KvRwSet, updates, commitMu); !valid || err != nil {
 			if err != nil {
 				return peer.TxValidationCode(-1), err
 			}
 			return peer.TxValidationCode_MVCC_READ_CONFLICT, nil
 		}
-		if valid, err := v.validateRangeQueries(ns, nsRWSet.KvRwSet.RangeQueriesInfo, updates); !valid || err != nil {
+		if valid, err := v.validateRangeQueries(ns, nsRWSet.KvRwSet.RangeQueriesInfo, updates, commitMu); !valid || err != nil {
 			if err != nil {
 				return peer.TxValidationCode(-1), err
 			}
 			return peer.TxValidationCode_PHANTOM_READ_CONFLICT, nil
 		}
+		for _, collHashedRWSet := range nsRWSet.CollHashedRwSets {
+			coll := collHashedRWSet.CollectionName
+			if valid, err := v.validateHashedReadSet(ns, coll, collHashedRWSet.HashedRwSet.HashedReads, updates, commitMu); !valid || err != nil {
+				if err != nil {
+					return peer.TxValidationCode(-1), err
+				}
+				return peer.TxValidationCode_MVCC_READ_CONFLICT, nil
+			}
+			if valid, err := v.validateHashedRangeQueries(ns, coll, collHashedRWSet.HashedRwSet.HashedRangeQueriesInfo, updates, commitMu); !valid || err != nil {
+				if err != nil {
+					return peer.TxValidationCode(-1), err
+				}
+				return peer.TxValidationCode_PHANTOM_READ_CONFLICT, nil
+			}
+		}
 	}
 	return peer.TxValidationCode_VALID, nil
 }
 
-func (v *Validator) validateReadSet(ns string, kvReads []*kvrwset.KVRead, updates *statedb.UpdateBatch) (bool, error) {
-	for _, kvRead := range kvReads {
-		if valid, err := v.validateKVRead(ns, kvRead, updates); !valid || err != nil {
+func (v *Validator) validateReadSet(ns string, kvRwSet *kvrwset.KVRWSet, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, error) {
+	// A read-set may carry a Merkle-hash summary alongside the full list of
+	// KVReads, the same idea already used for range queries (see
+	// validateRangeQuery below). When present, validate it with
+	// readSetHashValidator, which compares the committed versions against
+	// the endorser's tree a level at a time instead of one key at a time -
+	// see readSetHashValidator's doc comment for what that does and doesn't
+	// save over the raw path below.
+	if summary := kvRwSet.GetReadsMerkleSummary(); summary != nil {
+		logger.Debug(`Merkle hash summary is present in the read-set hence, initiating hashing based validation`)
+		hashValidator := &readSetHashValidator{ns: ns, reads: kvRwSet.Reads, summary: summary, v: v, updates: updates, commitMu: commitMu}
+		return hashValidator.validate()
+	}
+	logger.Debug(`Merkle hash summary is not present in the read-set hence, initiating raw KVReads based validation`)
+	for _, kvRead := range kvRwSet.Reads {
+		if valid, err := v.validateKVRead(ns, kvRead, updates, commitMu); !valid || err != nil {
 			return valid, err
 		}
 	}
@@ -397,9 +384,15 @@ func (v *Validator) validateReadSet(ns string, kvReads []*kvrwset.KVRead, update
 
 // validateKVRead performs mvcc check for a key read during transaction simulation.
 // i.e., it checks whether a key/version combination is already updated in the statedb (by an already committed block)
-// or in the updates (by a preceding valid transaction in the current block)
-func (v *Validator) validateKVRead(ns string, kvRead *kvrwset.KVRead, updates *statedb.UpdateBatch) (bool, error) {
-	if updates.Exists(ns, kvRead.Key) {
+// or in the updates (by a preceding valid transaction in the current block). commitMu
+// guards only the updates.Exists lookup, since updates is shared across every
+// transaction validating concurrently in the block; v.db.GetVersion reads the
+// already-committed state and needs no lock.
+func (v *Validator) validateKVRead(ns string, kvRead *kvrwset.KVRead, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, error) {
+	commitMu.Lock()
+	exists := updates.Exists(ns, kvRead.Key)
+	commitMu.Unlock()
+	if exists {
 		return false, nil
 	}
 	committedVersion, err := v.db.GetVersion(ns, kvRead.Key)
@@ -415,9 +408,9 @@ func (v *Validator) validateKVRead(ns string, kvRead *kvrwset.KVRead, updates *s
 	return true, nil
 }
 
-func (v *Validator) validateRangeQueries(ns string, rangeQueriesInfo []*kvrwset.RangeQueryInfo, updates *statedb.UpdateBatch) (bool, error) {
+func (v *Validator) validateRangeQueries(ns string, rangeQueriesInfo []*kvrwset.RangeQueryInfo, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, error) {
 	for _, rqi := range rangeQueriesInfo {
-		if valid, err := v.validateRangeQuery(ns, rqi, updates); !valid || err != nil {
+		if valid, err := v.validateRangeQuery(ns, rqi, updates, commitMu); !valid || err != nil {
 			return valid, err
 		}
 	}
@@ -427,8 +420,17 @@ func (v *Validator) validateRangeQueries(ns string, rangeQueriesInfo []*kvrwset.
 // validateRangeQuery performs a phatom read check i.e., it
 // checks whether the results of the range query are still the same when executed on the
 // statedb (latest state as of last committed block) + updates (prepared by the writes of preceding valid transactions
-// in the current block and yet to be committed as part of group commit at the end of the validation of the block)
-func (v *Validator) validateRangeQuery(ns string, rangeQueryInfo *kvrwset.RangeQueryInfo, updates *statedb.UpdateBatch) (bool, error) {
+// in the current block and yet to be committed as part of group commit at the end of the validation of the block).
+// Unlike validateKVRead and validateHashedKVRead, commitMu is held for the
+// combined iterator's entire lifetime, construction through the scan that
+// drives it, not narrowed to the updates lookup alone: a range scan walks an
+// arbitrary number of keys one at a time, and nothing here proves
+// newCombinedIterator hands back a point-in-time snapshot of updates rather
+// than a view that re-reads it on every Next(). Until that's established
+// (and exercised under -race with a concurrent writer), holding the lock
+// for the whole scan is the only safe option for a batch that other
+// in-flight transactions are still writing to.
+func (v *Validator) validateRangeQuery(ns string, rangeQueryInfo *kvrwset.RangeQueryInfo, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, error) {
 	logger.Debugf("validateRangeQuery: ns=%s, rangeQueryInfo=%s", ns, rangeQueryInfo)
 
 	// If during simulation, the caller had not exhausted the iterator so
@@ -436,6 +438,9 @@ func (v *Validator) validateRangeQuery(ns string, rangeQueryInfo *kvrwset.RangeQ
 	// but rather it is the last key seen by the caller and hence the combinedItr should include the endKey in the results.
 	includeEndKey := !rangeQueryInfo.ItrExhausted
 
+	commitMu.Lock()
+	defer commitMu.Unlock()
+
 	combinedItr, err := newCombinedIterator(v.db, updates,
 		ns, rangeQueryInfo.StartKey, rangeQueryInfo.EndKey, includeEndKey)
 	if err != nil {
@@ -453,3 +458,101 @@ func (v *Validator) validateRangeQuery(ns string, rangeQueryInfo *kvrwset.RangeQ
 	validator.init(rangeQueryInfo, combinedItr)
 	return validator.validate()
 }
+
+func (v *Validator) validateHashedReadSet(ns, coll string, hashedReads []*kvrwset.KVReadHash, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, error) {
+	for _, kvReadHash := range hashedReads {
+		if valid, err := v.validateHashedKVRead(ns, coll, kvReadHash, updates, commitMu); !valid || err != nil {
+			return valid, err
+		}
+	}
+	return true, nil
+}
+
+// validateHashedKVRead performs the mvcc check for a hashed key read belonging to a
+// private collection. It mirrors validateKVRead but resolves versions for the
+// hashed portion of the state, i.e., the namespace derived by privacyenabledstate
+// for the given namespace/collection pair, keyed by the hash of the private key.
+// As in validateKVRead, commitMu guards only the updates.Exists lookup.
+func (v *Validator) validateHashedKVRead(ns, coll string, kvReadHash *kvrwset.KVReadHash, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, error) {
+	hashedNs := privacyenabledstate.DeriveHashedDataNs(ns, coll)
+	keyHash := string(kvReadHash.KeyHash)
+	commitMu.Lock()
+	exists := updates.Exists(hashedNs, keyHash)
+	commitMu.Unlock()
+	if exists {
+		return false, nil
+	}
+	committedVersion, err := v.db.GetVersion(hashedNs, keyHash)
+	if err != nil {
+		return false, nil
+	}
+
+	if !version.AreSame(committedVersion, rwsetutil.NewVersion(kvReadHash.Version)) {
+		logger.Debugf("Version mismatch for hashed key [%s:%s:%#v]. Committed version = [%s], Version in hashed readSet [%s]",
+			ns, coll, kvReadHash.KeyHash, committedVersion, kvReadHash.Version)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (v *Validator) validateHashedRangeQueries(ns, coll string, rangeQueriesInfo []*kvrwset.RangeQueryInfo, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, error) {
+	for _, rqi := range rangeQueriesInfo {
+		if valid, err := v.validateHashedRangeQuery(ns, coll, rqi, updates, commitMu); !valid || err != nil {
+			return valid, err
+		}
+	}
+	return true, nil
+}
+
+// validateHashedRangeQuery performs a phantom-read check for a range query executed
+// by the chaincode against a private collection, using only the hashes of the keys
+// and values that are available to the validating peer. Unlike a public range query,
+// hashing a key destroys its relationship to the lexicographic order of the plaintext
+// keys, so there is no meaningful way to re-scan the collection's range directly over
+// the hashed namespace the way validateRangeQuery scans the public one: a "range" over
+// key hashes bounded by the plaintext StartKey/EndKey would visit an essentially
+// arbitrary set of entries and could neither confirm nor refute a phantom read.
+// Validation is therefore limited to the read results the transaction actually
+// declared for the range, each checked against the hashed namespace exactly as
+// validateHashedKVRead does for a standalone hashed read. A range query shipped as a
+// Merkle-summary only, with no raw reads to fall back on, cannot be validated at all
+// by this scheme, so it is rejected as a phantom-read conflict rather than silently
+// treated as valid.
+func (v *Validator) validateHashedRangeQuery(ns, coll string, rangeQueryInfo *kvrwset.RangeQueryInfo, updates *statedb.UpdateBatch, commitMu *sync.Mutex) (bool, error) {
+	logger.Debugf("validateHashedRangeQuery: ns=%s, coll=%s, rangeQueryInfo=%s", ns, coll, rangeQueryInfo)
+
+	if rangeQueryInfo.GetRawReads() == nil {
+		logger.Warningf("Block validation: hashed range query for ns=%s, coll=%s carries no raw reads to validate against "+
+			"(Merkle-summary-only range queries are not supported for private collections); rejecting as a phantom read",
+			ns, coll)
+		return false, nil
+	}
+
+	for _, hashedRead := range declaredHashedReadsOf(rangeQueryInfo) {
+		if valid, err := v.validateHashedKVRead(ns, coll, hashedRead, updates, commitMu); !valid || err != nil {
+			return valid, err
+		}
+	}
+	return true, nil
+}
+
+// declaredHashedReadsOf converts the raw KVReads a private range query declared into
+// KVReadHash entries keyed by the hash of each plaintext key, the same form
+// validateHashedKVRead expects for a standalone hashed read. Callers must not invoke
+// it when the query info carries only a Merkle summary - see validateHashedRangeQuery,
+// which rejects that case outright since the summary alone does not name the keys
+// needed to re-derive their hashes.
+func declaredHashedReadsOf(rangeQueryInfo *kvrwset.RangeQueryInfo) []*kvrwset.KVReadHash {
+	rawReads := rangeQueryInfo.GetRawReads()
+	if rawReads == nil {
+		return nil
+	}
+	hashedReads := make([]*kvrwset.KVReadHash, len(rawReads.KvReads))
+	for i, kvRead := range rawReads.KvReads {
+		hashedReads[i] = &kvrwset.KVReadHash{
+			KeyHash: commonutil.ComputeStringHash(kvRead.Key),
+			Version: kvRead.Version,
+		}
+	}
+	return hashedReads
+}
@@ -0,0 +1,124 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statebasedval
+
+import (
+	"bytes"
+	"testing"
+
+	commonutil "github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/protos/ledger/rwset/kvrwset"
+)
+
+// TestDeclaredHashedReadsOfConvertsRawReads covers the private collection
+// range query path: the declared raw reads of a hashed range query must be
+// converted to key-hash/version pairs to check against the hashed namespace,
+// never re-scanned by iterating the hashed namespace over the plaintext
+// StartKey/EndKey bounds (hashing a key does not preserve its lexicographic
+// position, so such a scan would visit an arbitrary, meaningless set of
+// entries).
+func TestDeclaredHashedReadsOfConvertsRawReads(t *testing.T) {
+	version := &kvrwset.Version{BlockNum: 3, TxNum: 1}
+	rangeQueryInfo := &kvrwset.RangeQueryInfo{
+		StartKey: "a",
+		EndKey:   "z",
+		ReadsInfo: &kvrwset.RangeQueryInfo_RawReads{
+			RawReads: &kvrwset.QueryReads{
+				KvReads: []*kvrwset.KVRead{
+					{Key: "apple", Version: version},
+				},
+			},
+		},
+	}
+
+	hashedReads := declaredHashedReadsOf(rangeQueryInfo)
+
+	if len(hashedReads) != 1 {
+		t.Fatalf("expected 1 hashed read, got %d", len(hashedReads))
+	}
+	wantHash := commonutil.ComputeStringHash("apple")
+	if !bytes.Equal(hashedReads[0].KeyHash, wantHash) {
+		t.Fatalf("expected key hash %x, got %x", wantHash, hashedReads[0].KeyHash)
+	}
+	if hashedReads[0].Version != version {
+		t.Fatalf("expected the raw read's version to be carried over unchanged")
+	}
+}
+
+// TestDeclaredHashedReadsOfMerkleSummaryOnly covers the case where the range
+// query was shipped as a Merkle summary with no raw reads: there are no
+// declared keys to hash, so nothing can be validated against the hashed
+// namespace and the result must be empty rather than attempting a scan.
+func TestDeclaredHashedReadsOfMerkleSummaryOnly(t *testing.T) {
+	rangeQueryInfo := &kvrwset.RangeQueryInfo{
+		StartKey: "a",
+		EndKey:   "z",
+		ReadsInfo: &kvrwset.RangeQueryInfo_ReadsMerkleHashes{
+			ReadsMerkleHashes: &kvrwset.QueryReadsMerkleSummary{MaxDegree: 2, MaxLevel: 1},
+		},
+	}
+
+	if hashedReads := declaredHashedReadsOf(rangeQueryInfo); hashedReads != nil {
+		t.Fatalf("expected no hashed reads for a Merkle-summary-only range query, got %v", hashedReads)
+	}
+}
+
+// TestReadSetOfUsesParsedTxsNotRawEnvelopes guards against reintroducing a
+// second, independent parse of the block's envelopes to build the
+// bulk-load key set: readSetOf must derive it purely from the txRWSet
+// already produced by parseBlockForValidation, including a nil entry for a
+// transaction skipped by the committer.
+func TestReadSetOfUsesParsedTxsNotRawEnvelopes(t *testing.T) {
+	parsedTxs := []*parsedTx{
+		rwTx(0, []string{"K1"}, []string{"K2"}),
+		nil,
+		postOrderTx(2),
+	}
+
+	readSet, hashedReadSet := readSetOf(parsedTxs)
+
+	if len(readSet) != 1 || readSet[0].Namespace != "ns" || readSet[0].Key != "K1" {
+		t.Fatalf("expected a single read-set entry for K1, got %v", readSet)
+	}
+	if len(hashedReadSet) != 0 {
+		t.Fatalf("expected no hashed reads, got %v", hashedReadSet)
+	}
+}
+
+// TestValidateHashedRangeQueryRejectsMerkleSummaryOnly guards against the
+// phantom-read check silently passing when a private range query ships only a
+// Merkle summary: with no raw reads to re-derive key hashes from, there is
+// nothing left to validate, so the query must be rejected rather than treated
+// as valid.
+func TestValidateHashedRangeQueryRejectsMerkleSummaryOnly(t *testing.T) {
+	v := &Validator{}
+	rangeQueryInfo := &kvrwset.RangeQueryInfo{
+		StartKey: "a",
+		EndKey:   "z",
+		ReadsInfo: &kvrwset.RangeQueryInfo_ReadsMerkleHashes{
+			ReadsMerkleHashes: &kvrwset.QueryReadsMerkleSummary{MaxDegree: 2, MaxLevel: 1},
+		},
+	}
+
+	valid, err := v.validateHashedRangeQuery("ns", "coll", rangeQueryInfo, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if valid {
+		t.Fatalf("expected a Merkle-summary-only hashed range query to be rejected, got valid=true")
+	}
+}